@@ -0,0 +1,31 @@
+package queryrange
+
+import (
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+)
+
+// Limits extends the cortex queryrange.Limits with the per-tenant overrides
+// consumed by this package's SplitStrategy and caching middlewares.
+type Limits interface {
+	queryrange.Limits
+
+	// MinSplitInterval is the smallest interval a high-volume candidate
+	// bucket may be subdivided down to.
+	MinSplitInterval(userID string) time.Duration
+
+	// MaxSplitsPerQuery caps how many sub-queries a single request may be
+	// fanned out into, regardless of how hot the volume probe reports a
+	// range to be.
+	MaxSplitsPerQuery(userID string) int
+
+	// TargetBytesPerSplit is the amount of chunk-store work a SplitStrategy
+	// should aim to put behind each sub-query.
+	TargetBytesPerSplit(userID string) int64
+
+	// CacheFreshness is how far back from now ResultsCacheMiddleware keeps
+	// buckets out of the cache, so the most recent data is never served
+	// stale.
+	CacheFreshness(userID string) time.Duration
+}
@@ -0,0 +1,58 @@
+package queryrange
+
+import (
+	"fmt"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// LokiPromRequest represents a LogQL metric (range-vector aggregation)
+// query, e.g. `rate({app="foo"}[1m])`. Its result is a Prometheus-style
+// matrix rather than a stream of log lines, so unlike LokiRequest it
+// carries no Direction or Limit: SplitByIntervalMiddleware fans its
+// sub-queries in fully and leaves stitching the matrix together to the
+// configured Merger.
+type LokiPromRequest struct {
+	Query   string
+	Step    int64 // milliseconds
+	StartTs int64 // milliseconds
+	EndTs   int64 // milliseconds
+	Path    string
+}
+
+func (r *LokiPromRequest) GetStart() int64  { return r.StartTs }
+func (r *LokiPromRequest) GetEnd() int64    { return r.EndTs }
+func (r *LokiPromRequest) GetStep() int64   { return r.Step }
+func (r *LokiPromRequest) GetQuery() string { return r.Query }
+
+func (r *LokiPromRequest) GetCachingOptions() queryrange.CachingOptions {
+	return queryrange.CachingOptions{}
+}
+
+func (r *LokiPromRequest) WithStartEnd(startTime, endTime int64) queryrange.Request {
+	clone := *r
+	clone.StartTs = startTime
+	clone.EndTs = endTime
+	return &clone
+}
+
+func (r *LokiPromRequest) WithQuery(query string) queryrange.Request {
+	clone := *r
+	clone.Query = query
+	return &clone
+}
+
+func (r *LokiPromRequest) LogToSpan(sp opentracing.Span) {
+	sp.LogFields(
+		otlog.String("query", r.Query),
+		otlog.Int64("start", r.StartTs),
+		otlog.Int64("end", r.EndTs),
+		otlog.Int64("step", r.Step),
+	)
+}
+
+func (r *LokiPromRequest) Reset()         { *r = LokiPromRequest{} }
+func (r *LokiPromRequest) String() string { return fmt.Sprintf("%+v", *r) }
+func (r *LokiPromRequest) ProtoMessage()  {}
@@ -0,0 +1,97 @@
+package queryrange
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+)
+
+// LokiPromResponse is the Prometheus-style matrix result of a LokiPromRequest
+// (a LogQL metric/range-vector query). SplitByIntervalMiddleware fans a
+// LokiPromRequest out into one sub-request per time window and, since it
+// carries no Limit to exit early on, always fans every sub-response back in
+// here for LokiPromResponseMerger to stitch into a single matrix.
+type LokiPromResponse struct {
+	Status string
+	Data   LokiPromMatrix
+}
+
+// LokiPromMatrix is a LogQL metric query's result: one series per distinct
+// label set, each carrying the samples for that series across the whole
+// queried range.
+type LokiPromMatrix struct {
+	ResultType string
+	Result     []LokiPromSeries
+}
+
+// LokiPromSeries is one series of a LokiPromMatrix, identified by its
+// canonical label string (e.g. `{app="foo"}`), and its samples in
+// ascending timestamp order.
+type LokiPromSeries struct {
+	Labels  string
+	Samples []LokiPromSample
+}
+
+// LokiPromSample is a single Prometheus-style sample.
+type LokiPromSample struct {
+	TimestampMs int64
+	Value       float64
+}
+
+func (r *LokiPromResponse) GetHeaders() []*queryrange.PrometheusResponseHeader { return nil }
+func (r *LokiPromResponse) Reset()                                             { *r = LokiPromResponse{} }
+func (r *LokiPromResponse) String() string                                     { return fmt.Sprintf("%+v", *r) }
+func (r *LokiPromResponse) ProtoMessage()                                      {}
+
+// LokiPromResponseMerger implements queryrange.Merger for LokiPromResponse.
+// It merges the per-window sub-responses splitByTime/AdaptiveByVolume
+// produced for a LokiPromRequest back into one matrix, concatenating each
+// series' samples across windows and re-sorting by timestamp: step
+// alignment means adjacent windows never duplicate or skip a sample (see
+// stepBoundary), so this only needs to stitch the pieces back together, not
+// deduplicate them.
+type LokiPromResponseMerger struct{}
+
+func (LokiPromResponseMerger) MergeResponse(responses ...queryrange.Response) (queryrange.Response, error) {
+	if len(responses) == 0 {
+		return &LokiPromResponse{}, nil
+	}
+
+	bySeries := map[string]*LokiPromSeries{}
+	var order []string
+
+	first, ok := responses[0].(*LokiPromResponse)
+	if !ok {
+		return nil, fmt.Errorf("LokiPromResponseMerger: unexpected response type %T, want *LokiPromResponse", responses[0])
+	}
+
+	for _, r := range responses {
+		resp, ok := r.(*LokiPromResponse)
+		if !ok {
+			return nil, fmt.Errorf("LokiPromResponseMerger: unexpected response type %T, want *LokiPromResponse", r)
+		}
+
+		for _, s := range resp.Data.Result {
+			series, ok := bySeries[s.Labels]
+			if !ok {
+				series = &LokiPromSeries{Labels: s.Labels}
+				bySeries[s.Labels] = series
+				order = append(order, s.Labels)
+			}
+			series.Samples = append(series.Samples, s.Samples...)
+		}
+	}
+
+	merged := make([]LokiPromSeries, 0, len(order))
+	for _, labels := range order {
+		s := bySeries[labels]
+		sort.Slice(s.Samples, func(i, j int) bool { return s.Samples[i].TimestampMs < s.Samples[j].TimestampMs })
+		merged = append(merged, *s)
+	}
+
+	return &LokiPromResponse{
+		Status: first.Status,
+		Data:   LokiPromMatrix{ResultType: first.Data.ResultType, Result: merged},
+	}, nil
+}
@@ -0,0 +1,91 @@
+package queryrange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+)
+
+// buildLokiPromResponse returns a single-series LokiPromResponse carrying
+// one sample per step in [startMs, endMs], the same inclusive-both-ends
+// convention stepBoundary uses for Prometheus range queries.
+func buildLokiPromResponse(startMs, endMs, stepMs int64) *LokiPromResponse {
+	var samples []LokiPromSample
+	for ts := startMs; ts <= endMs; ts += stepMs {
+		samples = append(samples, LokiPromSample{TimestampMs: ts, Value: float64(ts)})
+	}
+	return &LokiPromResponse{
+		Status: "success",
+		Data:   LokiPromMatrix{ResultType: "matrix", Result: []LokiPromSeries{{Labels: `{app="foo"}`, Samples: samples}}},
+	}
+}
+
+func TestLokiPromResponseMerger_StitchesSplitMatrixWithoutGapsOrDuplicates(t *testing.T) {
+	const stepMs = 15_000 // 15s
+
+	r := &LokiPromRequest{Query: `rate({app="foo"}[1m])`, StartTs: 0, EndTs: 3_600_000, Step: stepMs}
+
+	// Split the same way SplitByIntervalMiddleware would for a metric
+	// query, then build one response per window covering exactly that
+	// window's own samples, as h.next would for each sub-request.
+	subReqs := splitByTime(r, 10*time.Minute)
+	if len(subReqs) < 2 {
+		t.Fatalf("expected splitByTime to produce multiple windows, got %d", len(subReqs))
+	}
+
+	responses := make([]queryrange.Response, len(subReqs))
+	for i, sr := range subReqs {
+		s := sr.(SplittableRequest)
+		responses[i] = buildLokiPromResponse(s.GetStart(), s.GetEnd(), stepMs)
+	}
+
+	merged, err := (LokiPromResponseMerger{}).MergeResponse(responses...)
+	if err != nil {
+		t.Fatalf("MergeResponse returned error: %v", err)
+	}
+
+	want := buildLokiPromResponse(r.StartTs, r.EndTs, stepMs)
+
+	promResp, ok := merged.(*LokiPromResponse)
+	if !ok {
+		t.Fatalf("MergeResponse returned %T, want *LokiPromResponse", merged)
+	}
+	if len(promResp.Data.Result) != 1 {
+		t.Fatalf("got %d series, want 1", len(promResp.Data.Result))
+	}
+
+	got := promResp.Data.Result[0].Samples
+	wantSamples := want.Data.Result[0].Samples
+	if len(got) != len(wantSamples) {
+		t.Fatalf("got %d samples, want %d (split+merge must not drop or duplicate samples at window boundaries)", len(got), len(wantSamples))
+	}
+	for i := range wantSamples {
+		if got[i] != wantSamples[i] {
+			t.Errorf("sample %d: got %+v, want %+v", i, got[i], wantSamples[i])
+		}
+	}
+}
+
+func TestLokiPromResponseMerger_MergesDisjointSeriesAcrossWindows(t *testing.T) {
+	// Two sub-responses, each reporting a different series that only
+	// appeared in that window (e.g. a label value that only showed up in
+	// part of the range): the merged matrix must carry both in full,
+	// without one clobbering the other.
+	a := &LokiPromResponse{Data: LokiPromMatrix{Result: []LokiPromSeries{
+		{Labels: `{app="foo"}`, Samples: []LokiPromSample{{TimestampMs: 0, Value: 1}}},
+	}}}
+	b := &LokiPromResponse{Data: LokiPromMatrix{Result: []LokiPromSeries{
+		{Labels: `{app="bar"}`, Samples: []LokiPromSample{{TimestampMs: 15_000, Value: 2}}},
+	}}}
+
+	merged, err := (LokiPromResponseMerger{}).MergeResponse(a, b)
+	if err != nil {
+		t.Fatalf("MergeResponse returned error: %v", err)
+	}
+
+	promResp := merged.(*LokiPromResponse)
+	if len(promResp.Data.Result) != 2 {
+		t.Fatalf("got %d series, want 2 (one per distinct label set): %+v", len(promResp.Data.Result), promResp.Data.Result)
+	}
+}
@@ -0,0 +1,301 @@
+package queryrange
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/chunk/cache"
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/gogo/protobuf/proto"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/weaveworks/common/user"
+)
+
+// ResultsCacheMiddleware creates a new Middleware that caches each
+// per-interval LokiResponse it sees, keyed by (tenant, query, interval,
+// direction), and only forwards cache-miss intervals to next. It is meant
+// to sit above SplitByIntervalMiddleware: the intervals it buckets by line
+// up with the windows that middleware fans out to the chunk store, so a
+// cached bucket can be reused verbatim across requests that only extend or
+// shift the overall range.
+func ResultsCacheMiddleware(c cache.Cache, interval time.Duration, limits Limits, merger queryrange.Merger) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return &resultsCache{
+			next:     next,
+			cache:    c,
+			interval: interval,
+			limits:   limits,
+			merger:   merger,
+		}
+	})
+}
+
+type resultsCache struct {
+	next     queryrange.Handler
+	cache    cache.Cache
+	interval time.Duration
+	limits   Limits
+	merger   queryrange.Merger
+}
+
+// cacheBucket is one of the aligned sub-intervals a request is broken into
+// for the purposes of caching. cacheable is false for buckets that fall
+// within the tenant's CacheFreshness window of "now", since those cover
+// data that's still likely to change.
+type cacheBucket struct {
+	start, end time.Time
+	cacheable  bool
+	key        string
+}
+
+// cacheEntry is what's actually stored in the cache. Truncated records
+// whether Response was cut short by the originating request's Limit, so a
+// later request asking for more lines than Limit knows it can't reuse it.
+type cacheEntry struct {
+	Truncated bool
+	Limit     uint32
+	Response  []byte // proto-marshaled LokiResponse
+}
+
+func (h *resultsCache) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	lokiReq, ok := r.(*LokiRequest)
+	if !ok {
+		// nothing we know how to bucket and cache; pass through untouched.
+		return h.next.Do(ctx, r)
+	}
+
+	userID, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := h.buckets(userID, lokiReq)
+
+	responses := make([]queryrange.Response, len(buckets))
+	h.lookup(ctx, lokiReq, buckets, responses)
+
+	var missing []int
+	for i, resp := range responses {
+		if resp == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) > 0 {
+		fetched, err := h.fetchMissing(ctx, lokiReq, buckets, missing, h.limits.MaxQueryParallelism(userID))
+		if err != nil {
+			return nil, err
+		}
+		for i, idx := range missing {
+			responses[idx] = fetched[i]
+			if buckets[idx].cacheable {
+				h.store(ctx, buckets[idx].key, lokiReq.Limit, fetched[i])
+			}
+		}
+	}
+
+	return h.merger.MergeResponse(responses...)
+}
+
+// buckets lays the request's range out into sub-intervals aligned to
+// absolute multiples of h.interval, so that two requests covering the same
+// wall-clock window (e.g. a rolling "now-1h..now" dashboard refreshed a
+// minute apart) grid into the same cells and share cache keys. Only cells
+// fully contained in [r.StartTs, r.EndTs) are cacheable: the first and
+// last cell of a request are typically partial and keying them by their
+// clipped bounds would never collide with another request's grid anyway.
+func (h *resultsCache) buckets(userID string, r *LokiRequest) []cacheBucket {
+	freshCutoff := time.Now().Add(-h.limits.CacheFreshness(userID))
+
+	var buckets []cacheBucket
+	for cellStart := alignDown(r.StartTs, h.interval); cellStart.Before(r.EndTs); cellStart = cellStart.Add(h.interval) {
+		cellEnd := cellStart.Add(h.interval)
+
+		start, end, full := cellStart, cellEnd, true
+		if start.Before(r.StartTs) {
+			start = r.StartTs
+			full = false
+		}
+		if end.After(r.EndTs) {
+			end = r.EndTs
+			full = false
+		}
+		if !start.Before(end) {
+			continue
+		}
+
+		buckets = append(buckets, cacheBucket{
+			start:     start,
+			end:       end,
+			cacheable: full && !cellEnd.After(freshCutoff),
+			key:       cacheKey(userID, r.Query, r.Direction, cellStart, cellEnd),
+		})
+	}
+	return buckets
+}
+
+// alignDown rounds t down to the nearest preceding multiple of interval on
+// the absolute (Unix epoch) timeline.
+func alignDown(t time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		return t
+	}
+	return time.Unix(0, (t.UnixNano()/int64(interval))*int64(interval))
+}
+
+// lookup fills in responses[i] for every bucket whose cache entry exists
+// and can satisfy r.Limit, leaving the rest nil for the caller to treat as
+// misses.
+func (h *resultsCache) lookup(ctx context.Context, r *LokiRequest, buckets []cacheBucket, responses []queryrange.Response) {
+	keys := make([]string, 0, len(buckets))
+	idxByKey := make(map[string]int, len(buckets))
+	for i, b := range buckets {
+		if !b.cacheable {
+			continue
+		}
+		keys = append(keys, b.key)
+		idxByKey[b.key] = i
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	found, bufs, _ := h.cache.Fetch(ctx, keys)
+	for i, key := range found {
+		var entry cacheEntry
+		if err := decodeCacheEntry(bufs[i], &entry); err != nil {
+			continue
+		}
+		if !entryUsableForLimit(entry, uint32(r.Limit)) {
+			continue
+		}
+
+		resp := new(LokiResponse)
+		if err := proto.Unmarshal(entry.Response, resp); err != nil {
+			continue
+		}
+		responses[idxByKey[key]] = resp
+	}
+}
+
+// fetchMissing fetches the given bucket indices from next, respecting
+// parallelism the same way splitByInterval.Process does.
+func (h *resultsCache) fetchMissing(ctx context.Context, r *LokiRequest, buckets []cacheBucket, missing []int, parallelism int) ([]queryrange.Response, error) {
+	if parallelism <= 0 || parallelism > len(missing) {
+		parallelism = len(missing)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for _, idx := range missing {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- idx:
+			}
+		}
+	}()
+
+	results := make([]queryrange.Response, len(buckets))
+	errs := make(chan error, len(missing))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				b := buckets[idx]
+				resp, err := h.next.Do(ctx, &LokiRequest{
+					Query:     r.Query,
+					Limit:     r.Limit,
+					Step:      r.Step,
+					Direction: r.Direction,
+					Path:      r.Path,
+					StartTs:   b.start,
+					EndTs:     b.end,
+				})
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+
+				mu.Lock()
+				results[idx] = resp
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]queryrange.Response, len(missing))
+	for i, idx := range missing {
+		out[i] = results[idx]
+	}
+	return out, nil
+}
+
+func (h *resultsCache) store(ctx context.Context, key string, limit uint32, resp queryrange.Response) {
+	lokiResp, ok := resp.(*LokiResponse)
+	if !ok {
+		return
+	}
+
+	respBytes, err := proto.Marshal(lokiResp)
+	if err != nil {
+		return
+	}
+
+	buf, err := encodeCacheEntry(cacheEntry{
+		Truncated: limit > 0 && lokiResp.Count() >= int64(limit),
+		Limit:     limit,
+		Response:  respBytes,
+	})
+	if err != nil {
+		return
+	}
+
+	h.cache.Store(ctx, []string{key}, [][]byte{buf})
+}
+
+// entryUsableForLimit reports whether a cached entry can satisfy a request
+// asking for at most limit lines. A non-truncated entry already holds
+// every line the chunk store had for its interval, so any limit can reuse
+// it; a truncated one was cut short by its own request's limit and can
+// only be reused by a request that doesn't ask for more lines than that.
+func entryUsableForLimit(entry cacheEntry, limit uint32) bool {
+	return !entry.Truncated || limit <= entry.Limit
+}
+
+func cacheKey(userID, query string, direction logproto.Direction, start, end time.Time) string {
+	return fmt.Sprintf("%s:%s:%d:%d:%d", userID, query, direction, start.UnixNano(), end.UnixNano())
+}
+
+func encodeCacheEntry(e cacheEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCacheEntry(buf []byte, e *cacheEntry) error {
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(e)
+}
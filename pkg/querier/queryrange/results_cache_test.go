@@ -0,0 +1,118 @@
+package queryrange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+func TestEntryUsableForLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		truncated bool
+		cached    uint32
+		requested uint32
+		want      bool
+	}{
+		{name: "truncated, requested limit higher than cached: not reusable", truncated: true, cached: 100, requested: 200, want: false},
+		{name: "truncated, requested limit equal to cached: reusable", truncated: true, cached: 100, requested: 100, want: true},
+		{name: "truncated, requested limit lower than cached: reusable", truncated: true, cached: 100, requested: 50, want: true},
+		{name: "not truncated, requested limit far higher than cached: always reusable", truncated: false, cached: 100, requested: 100_000, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entry := cacheEntry{Truncated: tc.truncated, Limit: tc.cached}
+			if got := entryUsableForLimit(entry, tc.requested); got != tc.want {
+				t.Errorf("entryUsableForLimit(%+v, %d) = %v, want %v", entry, tc.requested, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResultsCache_Buckets_PartialEdgesNotCacheable(t *testing.T) {
+	h := &resultsCache{interval: 10 * time.Minute, limits: fakeLimits{}}
+
+	// A range from 00:05 to 00:25 grids into three 10-minute cells
+	// (00:00-00:10, 00:10-00:20, 00:20-00:30), but only the middle one is
+	// fully contained in the request; the first and last are clipped to
+	// the request's own bounds and must not be cached.
+	base := time.Date(2026, 7, 29, 0, 0, 0, 0, time.UTC)
+	r := &LokiRequest{
+		Query:     `{app="foo"}`,
+		Direction: logproto.FORWARD,
+		StartTs:   base.Add(5 * time.Minute),
+		EndTs:     base.Add(25 * time.Minute),
+	}
+
+	buckets := h.buckets("tenant", r)
+	if len(buckets) != 3 {
+		t.Fatalf("got %d buckets, want 3, for a 20m range gridded into 10m cells with a 5m offset: %+v", len(buckets), buckets)
+	}
+	if buckets[0].cacheable {
+		t.Errorf("first bucket %+v is clipped to the request's start and must not be cacheable", buckets[0])
+	}
+	if !buckets[1].cacheable {
+		t.Errorf("middle bucket %+v is fully contained in the request and should be cacheable", buckets[1])
+	}
+	if buckets[2].cacheable {
+		t.Errorf("last bucket %+v is clipped to the request's end and must not be cacheable", buckets[2])
+	}
+}
+
+func TestResultsCache_Buckets_WithinCacheFreshnessNotCacheable(t *testing.T) {
+	h := &resultsCache{interval: 10 * time.Minute, limits: fakeLimits{cacheFreshness: time.Hour}}
+
+	// A fully-contained cell that ends well within the last hour (the
+	// configured CacheFreshness window) must not be cached, since the
+	// data it covers may still be appended to.
+	now := time.Now()
+	cellStart := alignDown(now.Add(-15*time.Minute), 10*time.Minute)
+	r := &LokiRequest{
+		Query:     `{app="foo"}`,
+		Direction: logproto.FORWARD,
+		StartTs:   cellStart,
+		EndTs:     cellStart.Add(10 * time.Minute),
+	}
+
+	buckets := h.buckets("tenant", r)
+	if len(buckets) != 1 {
+		t.Fatalf("got %d buckets, want 1: %+v", len(buckets), buckets)
+	}
+	if buckets[0].cacheable {
+		t.Errorf("bucket %+v ending inside the CacheFreshness window must not be cacheable", buckets[0])
+	}
+}
+
+func TestResultsCache_Buckets_RangeShiftedRequestsCollideOnSharedCell(t *testing.T) {
+	h := &resultsCache{interval: 10 * time.Minute, limits: fakeLimits{}}
+
+	base := time.Date(2026, 7, 29, 0, 0, 0, 0, time.UTC)
+
+	// Two requests over the same rolling wall-clock window, as if
+	// re-issued a minute apart, both fully covering the cell
+	// [00:10, 00:20): their cache keys for that cell must match so the
+	// second request reuses the first's cached entry.
+	r1 := &LokiRequest{Query: `{app="foo"}`, Direction: logproto.FORWARD, StartTs: base, EndTs: base.Add(30 * time.Minute)}
+	r2 := &LokiRequest{Query: `{app="foo"}`, Direction: logproto.FORWARD, StartTs: base.Add(time.Minute), EndTs: base.Add(31 * time.Minute)}
+
+	key1 := findCacheableBucketKey(t, h.buckets("tenant", r1), base.Add(10*time.Minute), base.Add(20*time.Minute))
+	key2 := findCacheableBucketKey(t, h.buckets("tenant", r2), base.Add(10*time.Minute), base.Add(20*time.Minute))
+
+	if key1 != key2 {
+		t.Errorf("shared cell [00:10,00:20) got different cache keys across range-shifted requests: %q vs %q", key1, key2)
+	}
+}
+
+func findCacheableBucketKey(t *testing.T, buckets []cacheBucket, start, end time.Time) string {
+	t.Helper()
+	for _, b := range buckets {
+		if b.start.Equal(start) && b.end.Equal(end) {
+			if !b.cacheable {
+				t.Fatalf("bucket [%v,%v) expected to be cacheable: %+v", start, end, b)
+			}
+			return b.key
+		}
+	}
+	t.Fatalf("no bucket found for [%v,%v) in %+v", start, end, buckets)
+	return ""
+}
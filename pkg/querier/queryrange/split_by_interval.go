@@ -1,43 +1,76 @@
 package queryrange
 
 import (
+	"container/heap"
 	"context"
 	"time"
 
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
 	"github.com/grafana/loki/pkg/logproto"
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/weaveworks/common/user"
 )
 
-// SplitByIntervalMiddleware creates a new Middleware that splits log requests by a given interval.
-func SplitByIntervalMiddleware(interval time.Duration, limits queryrange.Limits, merger queryrange.Merger) queryrange.Middleware {
+// SplitByIntervalMiddleware creates a new Middleware that splits log requests
+// into fixed-width windows of the given interval.
+func SplitByIntervalMiddleware(interval time.Duration, limits Limits, merger queryrange.Merger) queryrange.Middleware {
+	return SplitByStrategyMiddleware(FixedInterval{interval: interval}, limits, merger)
+}
+
+// SplitByStrategyMiddleware creates a new Middleware that splits requests
+// using the given SplitStrategy. This allows swapping the fixed-width
+// splitting above for strategies that shape sub-queries around the actual
+// shard density of the range being queried, e.g. AdaptiveByVolume.
+func SplitByStrategyMiddleware(splitter SplitStrategy, limits Limits, merger queryrange.Merger) queryrange.Middleware {
 	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
 		return &splitByInterval{
 			next:     next,
 			limits:   limits,
 			merger:   merger,
-			interval: interval,
+			splitter: splitter,
 		}
 	})
 }
 
 type lokiResult struct {
 	req queryrange.Request
-	ch  chan *packedResp
+	// idx is the position of req in the direction-ordered split, i.e. idx 0
+	// is the earliest interval in the query's Direction. Process uses it to
+	// detect when a contiguous earliest-first prefix of responses has
+	// arrived, regardless of the order sub-queries actually complete in.
+	idx int
 }
 
 type packedResp struct {
+	idx  int
 	resp queryrange.Response
 	err  error
 }
 
+// pendingHeap orders not-yet-flushed responses by idx (ascending), so
+// Process can tell when the earliest-by-direction prefix of the split is
+// complete without waiting for every sub-query to return.
+type pendingHeap []*packedResp
+
+func (h pendingHeap) Len() int            { return len(h) }
+func (h pendingHeap) Less(i, j int) bool  { return h[i].idx < h[j].idx }
+func (h pendingHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pendingHeap) Push(x interface{}) { *h = append(*h, x.(*packedResp)) }
+func (h *pendingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
 type splitByInterval struct {
 	next     queryrange.Handler
-	limits   queryrange.Limits
+	limits   Limits
 	merger   queryrange.Merger
-	interval time.Duration
+	splitter SplitStrategy
 }
 
 func (h *splitByInterval) Feed(ctx context.Context, input []*lokiResult) chan *lokiResult {
@@ -62,12 +95,14 @@ func (h *splitByInterval) Process(
 	ctx context.Context,
 	parallelism int,
 	threshold int64,
+	limited bool,
 	input []*lokiResult,
 ) (responses []queryrange.Response, err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	ch := h.Feed(ctx, input)
+	respCh := make(chan *packedResp)
 
 	// don't spawn unnecessary goroutines
 	var p int = parallelism
@@ -76,33 +111,56 @@ func (h *splitByInterval) Process(
 	}
 
 	for i := 0; i < p; i++ {
-		go h.loop(ctx, ch)
+		go h.loop(ctx, ch, respCh)
 	}
 
-	for _, x := range input {
+	pending := &pendingHeap{}
+	heap.Init(pending)
+	next := 0 // idx of the earliest-by-direction response not yet flushed
+
+	for remaining := len(input); remaining > 0; remaining-- {
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
-		case data := <-x.ch:
+		case data := <-respCh:
 			if data.err != nil {
-				return nil, err
+				return nil, data.err
 			}
 
-			responses = append(responses, data.resp)
+			heap.Push(pending, data)
+
+			// flush every response that's now contiguous at the front of
+			// the earliest-by-direction prefix, even if later intervals
+			// are still in flight
+			for pending.Len() > 0 && (*pending)[0].idx == next {
+				d := heap.Pop(pending).(*packedResp)
+				responses = append(responses, d.resp)
+
+				// limited is false for metric (LogQL range-vector) queries:
+				// they have no Limit to exit early on and must fan in
+				// fully so the merger sees every sample.
+				if limited {
+					if lr, ok := d.resp.(*LokiResponse); ok {
+						threshold -= lr.Count()
+					}
+				}
+				next++
+			}
 
-			// see if we can exit early if a limit has been reached
-			threshold -= data.resp.(*LokiResponse).Count()
-			if threshold <= 0 {
+			// see if we can exit early if a limit has been reached; cancel
+			// aborts any h.next.Do calls still outstanding for intervals
+			// behind the flushed prefix
+			if limited && threshold <= 0 {
+				cancel()
 				return responses, nil
 			}
 		}
-
 	}
 
 	return responses, nil
 }
 
-func (h *splitByInterval) loop(ctx context.Context, ch <-chan *lokiResult) {
+func (h *splitByInterval) loop(ctx context.Context, ch <-chan *lokiResult, respCh chan<- *packedResp) {
 
 	for data := range ch {
 
@@ -113,44 +171,62 @@ func (h *splitByInterval) loop(ctx context.Context, ch <-chan *lokiResult) {
 
 		select {
 		case <-ctx.Done():
+			ext.Error.Set(sp, true)
+			sp.LogFields(otlog.Error(ctx.Err()))
 			sp.Finish()
 			return
-		case data.ch <- &packedResp{resp, err}:
+		case respCh <- &packedResp{idx: data.idx, resp: resp, err: err}:
 			sp.Finish()
 		}
 	}
 }
 
 func (h *splitByInterval) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
-	lokiRequest := r.(*LokiRequest)
+	splittable, ok := r.(SplittableRequest)
+	if !ok {
+		// nothing we know how to split; hand it to the next handler as-is.
+		return h.next.Do(ctx, r)
+	}
 
 	userid, err := user.ExtractOrgID(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	intervals := splitByTime(lokiRequest, h.interval)
+	intervals, err := h.splitter.Split(ctx, userid, splittable, h.limits)
+	if err != nil {
+		return nil, err
+	}
 
 	if sp := opentracing.SpanFromContext(ctx); sp != nil {
 		sp.LogFields(otlog.Int("n_intervals", len(intervals)))
 
 	}
 
-	if lokiRequest.Direction == logproto.BACKWARD {
-		for i, j := 0, len(intervals)-1; i < j; i, j = i+1, j-1 {
-			intervals[i], intervals[j] = intervals[j], intervals[i]
+	// Only log queries carry a Direction and a Limit to exit early on;
+	// metric (LogQL range-vector) queries fan in every interval.
+	var threshold int64
+	var limited bool
+	if lokiRequest, ok := r.(*LokiRequest); ok {
+		limited = true
+		threshold = int64(lokiRequest.Limit)
+
+		if lokiRequest.Direction == logproto.BACKWARD {
+			for i, j := 0, len(intervals)-1; i < j; i, j = i+1, j-1 {
+				intervals[i], intervals[j] = intervals[j], intervals[i]
+			}
 		}
 	}
 
 	input := make([]*lokiResult, 0, len(intervals))
-	for _, interval := range intervals {
+	for i, interval := range intervals {
 		input = append(input, &lokiResult{
 			req: interval,
-			ch:  make(chan *packedResp),
+			idx: i,
 		})
 	}
 
-	resps, err := h.Process(ctx, h.limits.MaxQueryParallelism(userid), int64(lokiRequest.Limit), input)
+	resps, err := h.Process(ctx, h.limits.MaxQueryParallelism(userid), threshold, limited, input)
 	if err != nil {
 		return nil, err
 	}
@@ -158,22 +234,84 @@ func (h *splitByInterval) Do(ctx context.Context, r queryrange.Request) (queryra
 	return h.merger.MergeResponse(resps...)
 }
 
-func splitByTime(r *LokiRequest, interval time.Duration) []queryrange.Request {
+// SplittableRequest is implemented by query types whose time range can be
+// partitioned into adjacent windows and reassembled by the pipeline's
+// Merger. Both log queries (*LokiRequest) and LogQL metric/range-vector
+// queries (*LokiPromRequest) satisfy it.
+type SplittableRequest interface {
+	GetStart() int64
+	GetEnd() int64
+	GetStep() int64
+	GetQuery() string
+	WithStartEnd(startTime, endTime int64) queryrange.Request
+}
+
+// SplitStrategy decides how a request is partitioned into sub-requests
+// before being fanned out to the next handler in the pipeline.
+type SplitStrategy interface {
+	Split(ctx context.Context, userID string, r SplittableRequest, limits Limits) ([]queryrange.Request, error)
+}
+
+// FixedInterval splits every request into fixed-width windows of interval.
+// It is the default SplitStrategy and matches Loki's historical behaviour.
+type FixedInterval struct {
+	interval time.Duration
+}
+
+func (f FixedInterval) Split(_ context.Context, _ string, r SplittableRequest, _ Limits) ([]queryrange.Request, error) {
+	return splitByTime(r, f.interval), nil
+}
+
+// splitByTime breaks r into fixed-width windows of interval. For metric
+// queries (GetStep() > 0) each window boundary is snapped to the request's
+// sample grid, relative to its start, so that splitting a query never
+// shifts where its returned samples fall.
+func splitByTime(r SplittableRequest, interval time.Duration) []queryrange.Request {
 	var reqs []queryrange.Request
-	for start := r.StartTs; start.Before(r.EndTs); start = start.Add(interval) {
-		end := start.Add(interval)
-		if end.After(r.EndTs) {
-			end = r.EndTs
-		}
-		reqs = append(reqs, &LokiRequest{
-			Query:     r.Query,
-			Limit:     r.Limit,
-			Step:      r.Step,
-			Direction: r.Direction,
-			Path:      r.Path,
-			StartTs:   start,
-			EndTs:     end,
-		})
+
+	startMs, endMs, stepMs := r.GetStart(), r.GetEnd(), r.GetStep()
+	intervalMs := interval.Milliseconds()
+
+	for start := startMs; start < endMs; {
+		end, next := stepBoundary(startMs, start, start+intervalMs, endMs, stepMs)
+		reqs = append(reqs, r.WithStartEnd(start, end))
+		start = next
 	}
 	return reqs
 }
+
+// stepBoundary computes the end of a sub-interval that starts at start,
+// given the unaligned candidateEnd a width-based split would otherwise
+// produce, and the start to use for the following sub-interval.
+//
+// For metric queries (stepMs > 0), candidateEnd is snapped down to the
+// request's sample grid relative to gridBase (the overall query's start),
+// so a split never shifts where a sample falls; if that snaps at or before
+// start (the configured width is narrower than a single step), it advances
+// to the next full step instead. Because Prometheus range queries are
+// inclusive of both endpoints, the returned next is stepMs past end, not
+// end itself, so the shared boundary sample isn't counted by both the
+// bucket that ends on it and the one that would otherwise start on it. If
+// that leaves no further full step before limit, end is pulled in to limit
+// instead of stopping one step short of it, so the request's own final
+// sample doesn't end up past every bucket's end.
+//
+// Log queries (stepMs == 0) get candidateEnd back unchanged, matching
+// Loki's historical fixed-width splitting.
+func stepBoundary(gridBase, start, candidateEnd, limit, stepMs int64) (end, next int64) {
+	if candidateEnd >= limit {
+		return limit, limit
+	}
+	if stepMs <= 0 {
+		return candidateEnd, candidateEnd
+	}
+
+	end = candidateEnd - (candidateEnd-gridBase)%stepMs
+	if end <= start {
+		end = start + stepMs
+	}
+	if next = end + stepMs; next >= limit {
+		return limit, limit
+	}
+	return end, next
+}
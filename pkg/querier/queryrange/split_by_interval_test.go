@@ -0,0 +1,370 @@
+package queryrange
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+// fakeLimits implements Limits, overriding only the methods this package's
+// SplitStrategy implementations and results cache read. Embedding the zero-value
+// queryrange.Limits interface satisfies every other method cortex's
+// interface requires without needing to know its full method set; none of
+// those are exercised by the tests below.
+type fakeLimits struct {
+	queryrange.Limits
+
+	minSplitInterval    time.Duration
+	maxSplitsPerQuery   int
+	targetBytesPerSplit int64
+	cacheFreshness      time.Duration
+}
+
+func (f fakeLimits) MinSplitInterval(string) time.Duration { return f.minSplitInterval }
+func (f fakeLimits) MaxSplitsPerQuery(string) int          { return f.maxSplitsPerQuery }
+func (f fakeLimits) TargetBytesPerSplit(string) int64      { return f.targetBytesPerSplit }
+func (f fakeLimits) CacheFreshness(string) time.Duration   { return f.cacheFreshness }
+
+// assertNoOverlapOrShift fails t if any two adjacent requests in reqs
+// either skip or double-count a sample on a stepMs grid anchored at
+// gridBase, or land off that grid. The very last bucket's end is exempted
+// from the grid check: it's intentionally clamped to the overall request's
+// end, which Prometheus's query_range doesn't require to fall on the step
+// grid itself.
+func assertNoOverlapOrShift(t *testing.T, reqs []queryrange.Request, gridBase, stepMs int64) {
+	t.Helper()
+
+	for i, req := range reqs {
+		s := req.(SplittableRequest)
+		if stepMs > 0 && (s.GetStart()-gridBase)%stepMs != 0 {
+			t.Errorf("bucket %d: start %d not aligned to step %d from base %d", i, s.GetStart(), stepMs, gridBase)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := reqs[i-1].(SplittableRequest)
+		if stepMs > 0 {
+			if want := prev.GetEnd() + stepMs; s.GetStart() != want {
+				t.Errorf("bucket %d starts at %d, want %d (prev end %d + step %d) so the shared sample isn't double-counted or skipped", i, s.GetStart(), want, prev.GetEnd(), stepMs)
+			}
+		} else if s.GetStart() != prev.GetEnd() {
+			t.Errorf("bucket %d starts at %d, want %d (prev end), for a non-metric split", i, s.GetStart(), prev.GetEnd())
+		}
+	}
+}
+
+func TestSplitByTime_MetricStepAlignment(t *testing.T) {
+	const stepMs = 15_000 // 15s
+
+	for _, tc := range []struct {
+		name     string
+		startMs  int64
+		endMs    int64
+		interval time.Duration
+	}{
+		{name: "interval wider than step, evenly divides", startMs: 0, endMs: 3_600_000, interval: time.Hour},
+		{name: "interval narrower than step falls back to one step", startMs: 0, endMs: 300_000, interval: time.Second},
+		{name: "range not a multiple of interval", startMs: 12_345, endMs: 1_234_567, interval: 10 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &LokiPromRequest{StartTs: tc.startMs, EndTs: tc.endMs, Step: stepMs}
+
+			reqs := splitByTime(r, tc.interval)
+			if len(reqs) == 0 {
+				t.Fatal("expected at least one sub-request")
+			}
+
+			assertNoOverlapOrShift(t, reqs, tc.startMs, stepMs)
+
+			last := reqs[len(reqs)-1].(SplittableRequest)
+			if last.GetEnd() != tc.endMs {
+				t.Errorf("last bucket ends at %d, want the request's end %d", last.GetEnd(), tc.endMs)
+			}
+		})
+	}
+}
+
+func TestSplitByTime_LogQueryUnaffected(t *testing.T) {
+	r := &LokiPromRequest{StartTs: 0, EndTs: 3_600_000, Step: 0}
+
+	reqs := splitByTime(r, 10*time.Minute)
+
+	assertNoOverlapOrShift(t, reqs, 0, 0)
+	if len(reqs) != 6 {
+		t.Fatalf("got %d buckets, want 6 for a 1h range split into 10m windows", len(reqs))
+	}
+}
+
+type constVolumeProbe int64
+
+func (p constVolumeProbe) Volume(_ context.Context, _ string, _, _ time.Time, _ string) (int64, error) {
+	return int64(p), nil
+}
+
+func TestAdaptiveByVolume_Split_MetricStepAlignment(t *testing.T) {
+	const stepMs = 15_000 // 15s
+
+	r := &LokiPromRequest{StartTs: 0, EndTs: 3_600_000, Step: stepMs}
+
+	// Each 10-minute candidate bucket reports well over target, forcing
+	// subdivide() to carve it up; none of it is low-volume enough to merge.
+	strategy := NewAdaptiveByVolume(10*time.Minute, constVolumeProbe(1_000_000))
+	limits := fakeLimits{targetBytesPerSplit: 100_000}
+
+	reqs, err := strategy.Split(context.Background(), "tenant", r, limits)
+	if err != nil {
+		t.Fatalf("Split returned error: %v", err)
+	}
+	if len(reqs) < 2 {
+		t.Fatalf("expected subdivide to produce more than one bucket, got %d", len(reqs))
+	}
+
+	assertNoOverlapOrShift(t, reqs, r.StartTs, stepMs)
+
+	last := reqs[len(reqs)-1].(SplittableRequest)
+	if last.GetEnd() != r.EndTs {
+		t.Errorf("last bucket ends at %d, want the request's end %d", last.GetEnd(), r.EndTs)
+	}
+}
+
+// byStartVolumeProbe reports a fixed volume per candidate bucket keyed by
+// its start time, so a test can make some buckets hot and others sparse.
+type byStartVolumeProbe map[int64]int64
+
+func (p byStartVolumeProbe) Volume(_ context.Context, _ string, start, _ time.Time, _ string) (int64, error) {
+	return p[start.UnixMilli()], nil
+}
+
+func TestAdaptiveByVolume_Split_SubdividedBucketsDontRemerge(t *testing.T) {
+	// A single bucket just over target: subdivide() halves it into two
+	// pieces that individually fall under target (bytes/n + bytes/n ==
+	// target). Since merge only ever runs before subdivide, those halves
+	// must come out the other end as two sub-queries, not get glued back
+	// into one because they'd satisfy a "<=target" check run against them.
+	r := &LokiPromRequest{StartTs: 0, EndTs: 600_000, Step: 0}
+
+	strategy := NewAdaptiveByVolume(10*time.Minute, constVolumeProbe(100_001))
+	limits := fakeLimits{targetBytesPerSplit: 100_000}
+
+	reqs, err := strategy.Split(context.Background(), "tenant", r, limits)
+	if err != nil {
+		t.Fatalf("Split returned error: %v", err)
+	}
+	if len(reqs) < 2 {
+		t.Fatalf("expected the hot bucket to stay subdivided into at least 2 sub-queries, got %d merged back into one", len(reqs))
+	}
+}
+
+func TestAdaptiveByVolume_Split_SparseBucketMergesBeforeSubdivide(t *testing.T) {
+	// Three 10-minute candidate buckets: warm, sparse, warm. Neither warm
+	// bucket alone exceeds target, so subdivide leaves all three as they
+	// are; the sparse bucket plus its left neighbour (60_000+1_000) stays
+	// under target, so merge must fold it into that neighbour rather than
+	// leave it as a sub-query of its own.
+	r := &LokiPromRequest{StartTs: 0, EndTs: 1_800_000, Step: 0}
+
+	probe := byStartVolumeProbe{
+		0:         60_000,
+		600_000:   1_000,
+		1_200_000: 60_000,
+	}
+	strategy := NewAdaptiveByVolume(10*time.Minute, probe)
+	limits := fakeLimits{targetBytesPerSplit: 100_000}
+
+	reqs, err := strategy.Split(context.Background(), "tenant", r, limits)
+	if err != nil {
+		t.Fatalf("Split returned error: %v", err)
+	}
+
+	for _, req := range reqs {
+		s := req.(SplittableRequest)
+		if s.GetStart() == 600_000 && s.GetEnd() == 1_200_000 {
+			t.Fatalf("sparse bucket [600000,1200000) was left standalone instead of merging into a neighbour: %+v", reqs)
+		}
+	}
+}
+
+// fakeHandler adapts a plain function to queryrange.Handler so tests can
+// control exactly when, and with what, each sub-query "completes".
+type fakeHandler struct {
+	do func(ctx context.Context, r queryrange.Request) (queryrange.Response, error)
+}
+
+func (f fakeHandler) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	return f.do(ctx, r)
+}
+
+// lokiResponseWithCount builds a *LokiResponse whose Count() reports n, by
+// giving it a single stream with n entries.
+func lokiResponseWithCount(n int) *LokiResponse {
+	return &LokiResponse{Data: LokiData{Result: []logproto.Stream{{Entries: make([]logproto.Entry, n)}}}}
+}
+
+// gatedInput is one sub-query in a Process test: it blocks inside the
+// handler until its gate is closed (or ctx is cancelled), so a test can
+// drive completion order independently of submission order.
+type gatedInput struct {
+	idx  int
+	gate chan struct{}
+	resp queryrange.Response
+}
+
+// release closes g's gate and waits for unblocked to report that this
+// sub-query's handler call has woken up and is on its way to respCh, before
+// returning control to the caller. It does not wait for the response to
+// reach Process over respCh, so sub-queries released back to back may
+// still be delivered to Process in either order.
+func release(g *gatedInput, unblocked <-chan int) {
+	close(g.gate)
+	<-unblocked
+}
+
+// newGatedInputs builds n gated sub-queries, idx 0..n-1, each returning the
+// given response once released, and a splitByInterval wired to a handler
+// that blocks on the matching gate. unblocked reports the idx of each
+// sub-query as its handler call wakes up, for release to synchronize on.
+func newGatedInputs(resps []queryrange.Response) ([]*lokiResult, []*gatedInput, chan int, *splitByInterval) {
+	gated := make([]*gatedInput, len(resps))
+	input := make([]*lokiResult, len(resps))
+	for i, resp := range resps {
+		g := &gatedInput{idx: i, gate: make(chan struct{}), resp: resp}
+		gated[i] = g
+		input[i] = &lokiResult{idx: i, req: &LokiPromRequest{StartTs: int64(i), EndTs: int64(i + 1)}}
+	}
+
+	unblocked := make(chan int, len(resps))
+	h := &splitByInterval{
+		next: fakeHandler{do: func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			idx := int(r.(*LokiPromRequest).StartTs)
+			select {
+			case <-gated[idx].gate:
+				unblocked <- idx
+				return gated[idx].resp, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}},
+	}
+	return input, gated, unblocked, h
+}
+
+func TestSplitByInterval_Process_EarlyCancelRespectsDirectionPrefix(t *testing.T) {
+	// idx2 is deliberately the highest-volume response and is released
+	// first, well out of submission order. If Process counted it against
+	// threshold as soon as it arrived, it would cancel and return
+	// immediately. Instead it must sit pending - out of order, but not yet
+	// contiguous with the unflushed idx0/idx1 - until the earliest-by-
+	// direction prefix catches up to it. idx3 is never released at all, so
+	// it only completes (with ctx.Err()) once cancel eventually aborts it.
+	resps := []queryrange.Response{
+		lokiResponseWithCount(2),
+		lokiResponseWithCount(3),
+		lokiResponseWithCount(1000),
+		lokiResponseWithCount(1),
+	}
+	input, gated, unblocked, h := newGatedInputs(resps)
+
+	idx3Done := make(chan error, 1)
+	orig := h.next
+	h.next = fakeHandler{do: func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+		idx := int(r.(*LokiPromRequest).StartTs)
+		resp, err := orig.Do(ctx, r)
+		if idx == 3 {
+			idx3Done <- err
+		}
+		return resp, err
+	}}
+
+	resultCh := make(chan []queryrange.Response, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		resps, err := h.Process(context.Background(), 4, 5, true, input)
+		resultCh <- resps
+		errCh <- err
+	}()
+
+	release(gated[2], unblocked)
+
+	// idx2's huge Count must not be counted against threshold yet: it's
+	// not contiguous with the still-unflushed idx0/idx1, so Process must
+	// still be blocked waiting, not already returned.
+	select {
+	case responses := <-resultCh:
+		t.Fatalf("Process returned early with %+v after only the out-of-order, non-contiguous idx2 arrived", responses)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Releasing idx0 then idx1 completes the earliest-by-direction prefix;
+	// once it does, idx2 is now contiguous too and flushes in the same
+	// batch, and their combined Count (2+3+1000) crosses the threshold,
+	// triggering cancel.
+	release(gated[0], unblocked)
+	release(gated[1], unblocked)
+
+	select {
+	case err := <-idx3Done:
+		if err != context.Canceled {
+			t.Fatalf("idx3's in-flight call finished with %v, want context.Canceled from Process's cancel()", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for cancel() to abort the in-flight idx3 call")
+	}
+
+	responses := <-resultCh
+	if err := <-errCh; err != nil {
+		t.Fatalf("Process returned error: %v", err)
+	}
+
+	if len(responses) != 3 {
+		t.Fatalf("got %d responses, want exactly [resp0, resp1, resp2]; idx3 (never completed, aborted by cancel) must not appear: %+v", len(responses), responses)
+	}
+	for i := 0; i < 3; i++ {
+		if responses[i] != resps[i] {
+			t.Fatalf("responses not emitted in direction (idx) order: got %+v", responses)
+		}
+	}
+}
+
+func TestSplitByInterval_Process_MetricFansInFullyWithoutEarlyExit(t *testing.T) {
+	// limited=false models a metric (LogQL range-vector) query: it has no
+	// per-response Count to exit early on, so every sub-query must fan in
+	// regardless of how it's ordered or how large threshold would suggest
+	// an early exit should be.
+	resps := []queryrange.Response{
+		lokiResponseWithCount(1000),
+		lokiResponseWithCount(1000),
+		lokiResponseWithCount(1000),
+	}
+	input, gated, unblocked, h := newGatedInputs(resps)
+
+	resultCh := make(chan []queryrange.Response, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		resps, err := h.Process(context.Background(), 3, 0, false, input)
+		resultCh <- resps
+		errCh <- err
+	}()
+
+	// Release in reverse submission order; full fan-in must not depend on
+	// completion order.
+	release(gated[2], unblocked)
+	release(gated[1], unblocked)
+	release(gated[0], unblocked)
+
+	responses := <-resultCh
+	if err := <-errCh; err != nil {
+		t.Fatalf("Process returned error: %v", err)
+	}
+
+	if len(responses) != 3 {
+		t.Fatalf("got %d responses, want all 3 (limited=false must fan in fully)", len(responses))
+	}
+	for i, resp := range responses {
+		if resp != resps[i] {
+			t.Fatalf("responses not emitted in direction (idx) order: got %+v", responses)
+		}
+	}
+}
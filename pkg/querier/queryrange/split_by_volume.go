@@ -0,0 +1,161 @@
+package queryrange
+
+import (
+	"context"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/cortexproject/cortex/pkg/util"
+)
+
+// VolumeProbe estimates, for a candidate time bucket, how many bytes of
+// chunk data the chunk store holds for a query's matchers. AdaptiveByVolume
+// uses this estimate to decide whether to merge a bucket into its
+// neighbours or subdivide it further. Implementations typically issue a
+// cheap logproto.SeriesRequest against the index or read chunk-index row
+// counts directly, rather than fetching and decompressing chunks.
+type VolumeProbe interface {
+	Volume(ctx context.Context, userID string, start, end time.Time, matchers string) (bytes int64, err error)
+}
+
+// AdaptiveByVolume is a SplitStrategy that lays a fixed grid of candidate
+// buckets across the requested range, probes each bucket's chunk volume via
+// probe, then merges adjacent low-volume buckets and subdivides high-volume
+// ones so each resulting sub-query targets roughly limits.TargetBytesPerSplit
+// of chunk-store work.
+type AdaptiveByVolume struct {
+	interval time.Duration
+	probe    VolumeProbe
+}
+
+// NewAdaptiveByVolume builds an AdaptiveByVolume strategy that grids the
+// request into buckets of the given interval before probing and reshaping
+// them.
+func NewAdaptiveByVolume(interval time.Duration, probe VolumeProbe) *AdaptiveByVolume {
+	return &AdaptiveByVolume{interval: interval, probe: probe}
+}
+
+// volumeBucket is a candidate sub-interval, in millisecond epoch bounds,
+// along with its probed (or estimated, once split) chunk volume in bytes.
+type volumeBucket struct {
+	start, end int64
+	bytes      int64
+}
+
+func (a *AdaptiveByVolume) Split(ctx context.Context, userID string, r SplittableRequest, limits Limits) ([]queryrange.Request, error) {
+	target := limits.TargetBytesPerSplit(userID)
+	if target <= 0 {
+		return splitByTime(r, a.interval), nil
+	}
+
+	startMs, endMs, stepMs := r.GetStart(), r.GetEnd(), r.GetStep()
+	intervalMs := a.interval.Milliseconds()
+
+	var buckets []volumeBucket
+	for start := startMs; start < endMs; {
+		end, next := stepBoundary(startMs, start, start+intervalMs, endMs, stepMs)
+
+		bytes, err := a.probe.Volume(ctx, userID, util.TimeFromMillis(start), util.TimeFromMillis(end), r.GetQuery())
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, volumeBucket{start: start, end: end, bytes: bytes})
+		start = next
+	}
+
+	minSplitMs := limits.MinSplitInterval(userID).Milliseconds()
+
+	// Merge adjacent low-volume buckets first, so sparse ranges don't spawn
+	// a sub-query per empty bucket, then subdivide whatever's left that's
+	// still over target. Subdivide must run last: a bucket it produces is
+	// sized to roughly target and is never a candidate for merging back
+	// into its neighbours, so running merge again afterwards would either
+	// immediately recombine a just-over-target bucket's halves or, if
+	// guarded against that, leave subdivided pieces unable to absorb a
+	// neighbouring sparse bucket either.
+	var merged []volumeBucket
+	for _, b := range buckets {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.bytes+b.bytes <= target {
+				last.end = b.end
+				last.bytes += b.bytes
+				continue
+			}
+		}
+		merged = append(merged, b)
+	}
+
+	var shaped []volumeBucket
+	for _, b := range merged {
+		shaped = append(shaped, subdivide(b, target, minSplitMs, startMs, stepMs)...)
+	}
+
+	if max := limits.MaxSplitsPerQuery(userID); max > 0 {
+		shaped = coalesceToLimit(shaped, max)
+	}
+
+	reqs := make([]queryrange.Request, 0, len(shaped))
+	for _, b := range shaped {
+		reqs = append(reqs, r.WithStartEnd(b.start, b.end))
+	}
+	return reqs, nil
+}
+
+// subdivide splits a bucket whose volume exceeds target into evenly-sized
+// sub-buckets no narrower than minSplitMs. Buckets at or under target are
+// returned unchanged. For metric queries (stepMs > 0) each sub-boundary is
+// snapped to the request's sample grid relative to gridBase via
+// stepBoundary, the same way the top-level candidate grid and splitByTime
+// are, so subdividing a hot bucket doesn't shift or double-count samples.
+func subdivide(b volumeBucket, target, minSplitMs, gridBase, stepMs int64) []volumeBucket {
+	if b.bytes <= target {
+		return []volumeBucket{b}
+	}
+
+	n := b.bytes / target
+	if b.bytes%target > 0 {
+		n++
+	}
+
+	sub := (b.end - b.start) / n
+	// floor sub to at least 1ms regardless of minSplitMs: when n exceeds
+	// the bucket's width (a very hot, narrow bucket), the division above
+	// truncates to 0 and the loop below would never advance.
+	floor := minSplitMs
+	if floor < 1 {
+		floor = 1
+	}
+	if sub < floor {
+		sub = floor
+	}
+
+	var out []volumeBucket
+	for s := b.start; s < b.end; {
+		e, next := stepBoundary(gridBase, s, s+sub, b.end, stepMs)
+		// fold a tail narrower than floor into this sub-bucket
+		if next < b.end && b.end-next < floor {
+			e, next = b.end, b.end
+		}
+		out = append(out, volumeBucket{start: s, end: e, bytes: b.bytes / n})
+		s = next
+	}
+	return out
+}
+
+// coalesceToLimit repeatedly merges the lowest-combined-volume adjacent pair
+// of buckets until at most max buckets remain.
+func coalesceToLimit(buckets []volumeBucket, max int) []volumeBucket {
+	for len(buckets) > max {
+		lowest := 0
+		for i := 1; i < len(buckets)-1; i++ {
+			if buckets[i].bytes+buckets[i+1].bytes < buckets[lowest].bytes+buckets[lowest+1].bytes {
+				lowest = i
+			}
+		}
+		buckets[lowest].end = buckets[lowest+1].end
+		buckets[lowest].bytes += buckets[lowest+1].bytes
+		buckets = append(buckets[:lowest+1], buckets[lowest+2:]...)
+	}
+	return buckets
+}